@@ -0,0 +1,71 @@
+// Copyright 2022-2024 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/parca-dev/parca-agent/pkg/selfprofiling"
+)
+
+var (
+	httpAddress = flag.String("http-address", ":7071", "address to bind the agent's metrics HTTP server to")
+
+	selfProfiling          = flag.Bool("self-profiling", false, "mount delta pprof endpoints (/debug/pprof/delta_{heap,block,mutex}) on the metrics server, so this agent's own profiler can be scraped for short-window, non-cumulative profiles")
+	selfProfilingMutexFrac = flag.Int("self-profiling-mutex-profile-fraction", 0, "passed to runtime.SetMutexProfileFraction when -self-profiling is set; 0 leaves the mutex profiler disabled")
+	selfProfilingBlockRate = flag.Int("self-profiling-block-profile-rate", 0, "passed to runtime.SetBlockProfileRate when -self-profiling is set; 0 leaves the block profiler disabled")
+)
+
+func main() {
+	flag.Parse()
+
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	reg := prometheus.NewRegistry()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	selfprofiling.Mount(mux, logger, selfprofiling.Config{
+		Enabled:              *selfProfiling,
+		MutexProfileFraction: *selfProfilingMutexFrac,
+		BlockProfileRate:     *selfProfilingBlockRate,
+	})
+
+	srv := &http.Server{Addr: *httpAddress, Handler: mux}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	level.Info(logger).Log("msg", "starting metrics HTTP server", "address", *httpAddress, "self_profiling", *selfProfiling)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		level.Error(logger).Log("msg", "metrics HTTP server exited", "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2022-2024 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Command perftest runs the CPU profiler against synthetic workloads for a
+// fixed duration and reports throughput/resource-usage metrics, or compares
+// two previously captured reports and fails if key metrics regressed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/profiler/cpu"
+	"github.com/parca-dev/parca-agent/test/integration/perftest"
+)
+
+func main() {
+	var (
+		duration       = flag.Duration("duration", 30*time.Second, "how long to run the perftest workloads for")
+		sampleInterval = flag.Duration("sample-interval", time.Second, "how often to sample resource usage")
+		goroutines     = flag.Int("cpu-goroutines", 0, "number of CPU-bound goroutines to run (0 = GOMAXPROCS)")
+		forkRate       = flag.Float64("fork-rate", 0, "processes/sec to fork+exec; 0 disables the forkexec workload")
+		guestBinary    = flag.String("guest-binary", "", "path to a guest process fixture (Python/Ruby/JVM) to run under load; empty disables the guest workload")
+		guestArgs      = flag.String("guest-args", "", "comma-separated arguments to pass to -guest-binary")
+		guestCount     = flag.Int("guest-count", 1, "number of concurrent -guest-binary instances to keep running")
+		reportJSON     = flag.String("report", "perftest-report.json", "path to write the JSON report to")
+		reportMD       = flag.String("report-markdown", "", "path to write a markdown summary to (optional)")
+		pprofDir       = flag.String("pprof-dir", "", "directory to capture perftest's own cpu/heap/block/mutex/trace profiles to (optional)")
+		tempDir        = flag.String("temp-dir", "", "scratch directory for the profiler under test (defaults to a new temp dir)")
+		compareWith    = flag.String("compare", "", "path to a prior -report JSON file; if set, runs nothing and diffs against it instead")
+	)
+	flag.Parse()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	if *compareWith != "" {
+		baseline, err := perftest.ReadJSON(*compareWith)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to read baseline report", "err", err)
+			os.Exit(1)
+		}
+		candidate, err := perftest.ReadJSON(*reportJSON)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to read candidate report", "err", err)
+			os.Exit(1)
+		}
+		regressions := perftest.Compare(baseline, candidate, perftest.DefaultThresholds)
+		if len(regressions) > 0 {
+			for _, r := range regressions {
+				fmt.Fprintln(os.Stderr, "REGRESSION:", r)
+			}
+			os.Exit(1)
+		}
+		fmt.Println("no regressions found")
+		return
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	scratch := *tempDir
+	if scratch == "" {
+		var err error
+		scratch, err = os.MkdirTemp("", "perftest")
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to create temp dir", "err", err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(scratch)
+	}
+
+	reg := prometheus.NewRegistry()
+	ofp := objectfile.NewPool(logger, reg, "", 0, 0)
+	defer ofp.Close()
+
+	cfg := perftest.Config{
+		Duration:       *duration,
+		SampleInterval: *sampleInterval,
+		PprofDir:       *pprofDir,
+		Workloads: []perftest.Workload{
+			{Kind: perftest.WorkloadCPU, Goroutines: *goroutines},
+		},
+	}
+	if *forkRate > 0 {
+		cfg.Workloads = append(cfg.Workloads, perftest.Workload{
+			Kind:         perftest.WorkloadForkExec,
+			ForkRate:     *forkRate,
+			ForkLifetime: 100 * time.Millisecond,
+		})
+	}
+	if *guestBinary != "" {
+		var args []string
+		if *guestArgs != "" {
+			args = strings.Split(*guestArgs, ",")
+		}
+		cfg.Workloads = append(cfg.Workloads, perftest.Workload{
+			Kind:        perftest.WorkloadGuestProcess,
+			GuestBinary: *guestBinary,
+			GuestArgs:   args,
+			Count:       *guestCount,
+		})
+	}
+
+	level.Info(logger).Log("msg", "running perftest", "duration", *duration)
+	report, err := perftest.Run(ctx, logger, reg, ofp, scratch, &cpu.Config{}, cfg)
+	if err != nil {
+		level.Error(logger).Log("msg", "perftest run failed", "err", err)
+		os.Exit(1)
+	}
+
+	if err := perftest.WriteJSON(*reportJSON, report); err != nil {
+		level.Error(logger).Log("msg", "failed to write report", "err", err)
+		os.Exit(1)
+	}
+	if *reportMD != "" {
+		if err := perftest.WriteMarkdown(*reportMD, report); err != nil {
+			level.Error(logger).Log("msg", "failed to write markdown report", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	level.Info(logger).Log("msg", "perftest complete", "samples_per_sec", report.SamplesPerSec, "dropped_samples", report.DroppedSamples)
+}
@@ -0,0 +1,286 @@
+// Copyright 2022-2024 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package selfprofiling mounts net/http/pprof together with delta-encoded
+// heap/block/mutex handlers onto the agent's own metrics HTTP server, so a
+// second parca-agent (or a Parca server) can scrape parca-agent itself and
+// get short-window, non-cumulative profiles of the profiler.
+package selfprofiling
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	goruntime "runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	pprofprofile "github.com/google/pprof/profile"
+)
+
+// Config controls whether the self-profiling HTTP endpoints are mounted.
+// It is populated from the `--self-profiling` flag in main.
+type Config struct {
+	Enabled bool
+
+	// MutexProfileFraction and BlockProfileRate are forwarded to
+	// runtime.SetMutexProfileFraction and runtime.SetBlockProfileRate when
+	// Enabled is true, since both profiles are empty by default.
+	MutexProfileFraction int
+	BlockProfileRate     int
+}
+
+// deltaClientCookie is set on the first request from a given scraper so that
+// subsequent scrapes from the same client diff against their own previous
+// baseline, instead of a baseline shared across all scrapers.
+//
+// This only works for scrapers that round-trip cookies, which most
+// Prometheus-style scrape clients (including Parca's) do not: they use a
+// bare http.Client with no cookie jar. Against those, every scrape looks
+// like a new client, so the delta_* endpoints silently fall back to
+// returning a cumulative profile on every request. Operators that want
+// actual deltas must configure their scraper to send a stable client_id
+// query parameter (e.g. "?client_id=<scraper instance name>") instead of
+// relying on the cookie.
+const deltaClientCookie = "parca_agent_delta_client"
+
+// clientTTL bounds how long an idle client's baseline profile is kept. It
+// exists so that scrapers which never resend a client_id or cookie (so get a
+// fresh newClientID() every request) don't leak one *pprofprofile.Profile
+// per scrape forever.
+const clientTTL = 10 * time.Minute
+
+// Mount registers net/http/pprof's standard handlers and the delta_heap,
+// delta_block and delta_mutex handlers on mux, and turns on the block/mutex
+// profilers according to cfg.BlockProfileRate and cfg.MutexProfileFraction
+// (see Config). It does nothing when cfg.Enabled is false.
+func Mount(mux *http.ServeMux, logger log.Logger, cfg Config) {
+	if !cfg.Enabled {
+		return
+	}
+	cfg.apply(logger)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	d := newDeltaProfiler(logger)
+	mux.HandleFunc("/debug/pprof/delta_heap", d.handler("heap"))
+	mux.HandleFunc("/debug/pprof/delta_block", d.handler("block"))
+	mux.HandleFunc("/debug/pprof/delta_mutex", d.handler("mutex"))
+}
+
+func (c Config) apply(logger log.Logger) {
+	if c.MutexProfileFraction > 0 {
+		goruntime.SetMutexProfileFraction(c.MutexProfileFraction)
+	}
+	if c.BlockProfileRate > 0 {
+		goruntime.SetBlockProfileRate(c.BlockProfileRate)
+	}
+	level.Info(logger).Log("msg", "self-profiling endpoints mounted", "path", "/debug/pprof/delta_{heap,block,mutex}")
+}
+
+// deltaProfiler keeps the last cumulative profile seen per (client, profile
+// name) pair so that it can be subtracted from the next one.
+type deltaProfiler struct {
+	logger log.Logger
+
+	mu   sync.Mutex
+	prev map[string]*clientBaseline // client -> last cumulative profile per profile name, plus last-seen time.
+}
+
+type clientBaseline struct {
+	profiles map[string]*pprofprofile.Profile // profile name -> last cumulative profile.
+	lastSeen time.Time
+}
+
+func newDeltaProfiler(logger log.Logger) *deltaProfiler {
+	return &deltaProfiler{
+		logger: logger,
+		prev:   make(map[string]*clientBaseline),
+	}
+}
+
+// evictLocked drops clients that haven't been seen in clientTTL. Must be
+// called with d.mu held.
+func (d *deltaProfiler) evictLocked(now time.Time) {
+	for client, baseline := range d.prev {
+		if now.Sub(baseline.lastSeen) > clientTTL {
+			delete(d.prev, client)
+		}
+	}
+}
+
+func (d *deltaProfiler) handler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := runtimepprof.Lookup(name)
+		if p == nil {
+			http.Error(w, fmt.Sprintf("unknown profile %q", name), http.StatusNotFound)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := p.WriteTo(&buf, 0); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		cur, err := pprofprofile.Parse(&buf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		client := clientKey(w, r)
+		out := d.diff(client, name, cur)
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if err := out.Write(w); err != nil {
+			level.Warn(d.logger).Log("msg", "failed to write delta profile", "profile", name, "err", err)
+		}
+	}
+}
+
+// diff returns cur with its cumulative sample values replaced by cur-prev
+// (matched by stack signature, i.e. the sequence of function@line for each
+// sample's locations), and stores cur as the new baseline for client. Gauge
+// value types (runtime/pprof's heap profile mixes cumulative alloc_objects/
+// alloc_space columns with point-in-time inuse_objects/inuse_space columns,
+// see gaugeValueTypeIndices) are passed through from cur unchanged rather
+// than diffed, since subtracting two point-in-time readings of "currently
+// live" memory does not produce a meaningful delta. Cumulative columns with
+// no matching previous sample, or whose value would go negative (e.g. after
+// the process's internal profile buffers reset), are likewise reported
+// unchanged from cur.
+func (d *deltaProfiler) diff(client, name string, cur *pprofprofile.Profile) *pprofprofile.Profile {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.evictLocked(now)
+
+	baseline, ok := d.prev[client]
+	if !ok {
+		baseline = &clientBaseline{profiles: make(map[string]*pprofprofile.Profile)}
+		d.prev[client] = baseline
+	}
+	baseline.lastSeen = now
+	prev := baseline.profiles[name]
+	baseline.profiles[name] = cur
+
+	if prev == nil {
+		// First scrape from this client: nothing to diff against yet. This
+		// is also what every scrape looks like for a client that isn't
+		// sending a stable client_id/cookie, since each one mints a new
+		// client key; see deltaClientCookie's doc comment.
+		return cur
+	}
+
+	prevByStack := make(map[string][]int64, len(prev.Sample))
+	for _, s := range prev.Sample {
+		prevByStack[stackKey(s)] = s.Value
+	}
+	gaugeIdx := gaugeValueTypeIndices(cur)
+
+	out := cur.Copy()
+	for _, s := range out.Sample {
+		prevValue, ok := prevByStack[stackKey(s)]
+		if !ok {
+			continue
+		}
+		for i := range s.Value {
+			if gaugeIdx[i] {
+				// Point-in-time value (e.g. inuse_space): report cur's raw
+				// reading, not a diff against the previous reading.
+				continue
+			}
+			if i >= len(prevValue) {
+				break
+			}
+			if d := s.Value[i] - prevValue[i]; d >= 0 {
+				s.Value[i] = d
+			}
+		}
+	}
+	return out
+}
+
+// gaugeValueTypeIndices returns the set of sample-value indices in p that
+// are point-in-time gauges rather than cumulative counters. Only
+// runtime/pprof's heap profile mixes the two: its sample types are
+// [alloc_objects, alloc_space, inuse_objects, inuse_space], where alloc_* is
+// cumulative since process start but inuse_* is "currently live" (see
+// runtime/pprof/protomem.go). Block and mutex profiles' sample types
+// (contentions, delay) are both cumulative counters, so this returns an
+// empty set for them.
+func gaugeValueTypeIndices(p *pprofprofile.Profile) map[int]bool {
+	idx := make(map[int]bool)
+	for i, st := range p.SampleType {
+		if strings.HasPrefix(st.Type, "inuse") {
+			idx[i] = true
+		}
+	}
+	return idx
+}
+
+// stackKey identifies a sample by its call stack's function names and line
+// numbers rather than by location ID, since those IDs are only stable within
+// a single runtime/pprof dump.
+func stackKey(s *pprofprofile.Sample) string {
+	var b bytes.Buffer
+	for _, loc := range s.Location {
+		for _, line := range loc.Line {
+			if line.Function != nil {
+				b.WriteString(line.Function.Name)
+			}
+			fmt.Fprintf(&b, ":%d;", line.Line)
+		}
+	}
+	return b.String()
+}
+
+func clientKey(w http.ResponseWriter, r *http.Request) string {
+	if id := r.URL.Query().Get("client_id"); id != "" {
+		return id
+	}
+	if c, err := r.Cookie(deltaClientCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	id := newClientID()
+	http.SetCookie(w, &http.Cookie{Name: deltaClientCookie, Value: id, Path: "/debug/pprof"})
+	return id
+}
+
+func newClientID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// crypto/rand.Read on a supported platform does not fail; fall back
+		// to a constant instead of panicking. Every client that gets this
+		// key shares one baseline.
+		return "default"
+	}
+	return hex.EncodeToString(buf[:])
+}
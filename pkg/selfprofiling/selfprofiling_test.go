@@ -0,0 +1,192 @@
+// Copyright 2022-2024 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package selfprofiling
+
+import (
+	"testing"
+	"time"
+
+	pprofprofile "github.com/google/pprof/profile"
+
+	"github.com/go-kit/log"
+)
+
+func testFunction(name string) *pprofprofile.Function {
+	return &pprofprofile.Function{ID: 1, Name: name}
+}
+
+func testLocation(fn *pprofprofile.Function) *pprofprofile.Location {
+	return &pprofprofile.Location{
+		ID:   1,
+		Line: []pprofprofile.Line{{Function: fn, Line: 42}},
+	}
+}
+
+// heapProfile builds a synthetic profile shaped like runtime/pprof's heap
+// profile: [alloc_objects, alloc_space, inuse_objects, inuse_space].
+func heapProfile(value []int64) *pprofprofile.Profile {
+	fn := testFunction("main.allocate")
+	loc := testLocation(fn)
+	return &pprofprofile.Profile{
+		SampleType: []*pprofprofile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+			{Type: "inuse_objects", Unit: "count"},
+			{Type: "inuse_space", Unit: "bytes"},
+		},
+		Sample:   []*pprofprofile.Sample{{Location: []*pprofprofile.Location{loc}, Value: value}},
+		Location: []*pprofprofile.Location{loc},
+		Function: []*pprofprofile.Function{fn},
+	}
+}
+
+// counterProfile builds a synthetic profile shaped like runtime/pprof's
+// block/mutex profiles: both sample-value columns are cumulative counters.
+func counterProfile(value []int64) *pprofprofile.Profile {
+	fn := testFunction("main.lock")
+	loc := testLocation(fn)
+	return &pprofprofile.Profile{
+		SampleType: []*pprofprofile.ValueType{
+			{Type: "contentions", Unit: "count"},
+			{Type: "delay", Unit: "nanoseconds"},
+		},
+		Sample:   []*pprofprofile.Sample{{Location: []*pprofprofile.Location{loc}, Value: value}},
+		Location: []*pprofprofile.Location{loc},
+		Function: []*pprofprofile.Function{fn},
+	}
+}
+
+func TestDeltaProfilerDiffFirstScrapeReturnsRaw(t *testing.T) {
+	d := newDeltaProfiler(log.NewNopLogger())
+	cur := heapProfile([]int64{10, 1000, 5, 500})
+
+	out := d.diff("client-a", "heap", cur)
+
+	if out != cur {
+		t.Fatalf("first scrape should return cur unchanged, got a different profile")
+	}
+}
+
+func TestDeltaProfilerDiffHeapPassesThroughGaugesAndDeltasCounters(t *testing.T) {
+	d := newDeltaProfiler(log.NewNopLogger())
+
+	// alloc_objects, alloc_space, inuse_objects, inuse_space.
+	first := heapProfile([]int64{10, 1000, 5, 500})
+	d.diff("client-a", "heap", first)
+
+	// Live heap grew from 500 to 1500 bytes; cumulative allocations grew too.
+	second := heapProfile([]int64{25, 2500, 12, 1500})
+	out := d.diff("client-a", "heap", second)
+
+	got := out.Sample[0].Value
+	want := []int64{15, 1500, 12, 1500} // alloc_* delta'd, inuse_* passed through raw.
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("value[%d] = %d, want %d (full: %v)", i, got[i], want[i], got)
+		}
+	}
+}
+
+func TestDeltaProfilerDiffCounterProfileDeltasAllColumns(t *testing.T) {
+	d := newDeltaProfiler(log.NewNopLogger())
+
+	first := counterProfile([]int64{10, 1000})
+	d.diff("client-a", "mutex", first)
+
+	second := counterProfile([]int64{30, 1800})
+	out := d.diff("client-a", "mutex", second)
+
+	got := out.Sample[0].Value
+	want := []int64{20, 800}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("value[%d] = %d, want %d (full: %v)", i, got[i], want[i], got)
+		}
+	}
+}
+
+func TestDeltaProfilerDiffNegativeDeltaFallsBackToRaw(t *testing.T) {
+	d := newDeltaProfiler(log.NewNopLogger())
+
+	first := counterProfile([]int64{30, 1800})
+	d.diff("client-a", "mutex", first)
+
+	// Counters reset (e.g. process restarted its internal buffers): current
+	// cumulative value is lower than the stored baseline.
+	second := counterProfile([]int64{5, 200})
+	out := d.diff("client-a", "mutex", second)
+
+	got := out.Sample[0].Value
+	want := []int64{5, 200}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("value[%d] = %d, want %d (full: %v)", i, got[i], want[i], got)
+		}
+	}
+}
+
+func TestDeltaProfilerDiffSeparatesClientsAndProfileNames(t *testing.T) {
+	d := newDeltaProfiler(log.NewNopLogger())
+
+	d.diff("client-a", "mutex", counterProfile([]int64{10, 1000}))
+
+	// A different client's first scrape should still be treated as a first
+	// scrape, not diffed against client-a's baseline.
+	out := d.diff("client-b", "mutex", counterProfile([]int64{999, 999999}))
+	if out.Sample[0].Value[0] != 999 {
+		t.Fatalf("client-b's first scrape was diffed against client-a's baseline: got %v", out.Sample[0].Value)
+	}
+
+	// The same client's first scrape of a different profile name should not
+	// be diffed against its baseline for another profile name.
+	out = d.diff("client-a", "block", counterProfile([]int64{999, 999999}))
+	if out.Sample[0].Value[0] != 999 {
+		t.Fatalf("client-a's first block scrape was diffed against its mutex baseline: got %v", out.Sample[0].Value)
+	}
+}
+
+func TestDeltaProfilerEvictsStaleClients(t *testing.T) {
+	d := newDeltaProfiler(log.NewNopLogger())
+
+	d.diff("client-a", "mutex", counterProfile([]int64{10, 1000}))
+
+	d.mu.Lock()
+	d.prev["client-a"].lastSeen = time.Now().Add(-2 * clientTTL)
+	d.mu.Unlock()
+
+	// A scrape from an unrelated client triggers the sweep; client-a's
+	// baseline should be gone, so a subsequent scrape from client-a is
+	// treated as a first scrape again (raw values, not diffed).
+	d.diff("client-c", "mutex", counterProfile([]int64{1, 1}))
+
+	out := d.diff("client-a", "mutex", counterProfile([]int64{5, 500}))
+	if out.Sample[0].Value[0] != 5 {
+		t.Fatalf("expected evicted client to be treated as a first scrape, got %v", out.Sample[0].Value)
+	}
+}
+
+func TestStackKeyMatchesSameStackAcrossProfiles(t *testing.T) {
+	a := heapProfile([]int64{1, 1, 1, 1})
+	b := heapProfile([]int64{2, 2, 2, 2})
+
+	if stackKey(a.Sample[0]) != stackKey(b.Sample[0]) {
+		t.Fatalf("stackKey should match equivalent stacks across separate profile instances")
+	}
+
+	other := counterProfile([]int64{1, 1})
+	if stackKey(a.Sample[0]) == stackKey(other.Sample[0]) {
+		t.Fatalf("stackKey should not match stacks from different functions")
+	}
+}
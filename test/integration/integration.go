@@ -17,8 +17,11 @@ package integration
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
 	"os"
@@ -58,6 +61,26 @@ import (
 	"github.com/parca-dev/parca-agent/pkg/vdso"
 )
 
+// keepArtifacts preserves the sample artifacts written by RunAndAwaitSamples
+// even when the test passes, instead of only on failure. It is only set if
+// RegisterFlags was called; this package does not register the flag itself,
+// since it's also imported by non-test binaries (e.g. cmd/perftest) that
+// have no use for it and shouldn't advertise or fight over it.
+var keepArtifacts bool
+
+// RegisterFlags registers this package's test flags (currently just
+// -keep-artifacts) on fs. Call it from a TestMain in the test binary that
+// uses RunAndAwaitSamples, e.g.:
+//
+//	func TestMain(m *testing.M) {
+//		integration.RegisterFlags(flag.CommandLine)
+//		flag.Parse()
+//		os.Exit(m.Run())
+//	}
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&keepArtifacts, "keep-artifacts", false, "keep sample artifacts captured by RunAndAwaitSamples even when the test passes")
+}
+
 type Sample struct {
 	Labels  model.LabelSet
 	Profile *pprofprofile.Profile
@@ -108,6 +131,9 @@ func (tpw *TestProfileStore) SampleForProcess(pid int, last bool) *Sample { // n
 
 type TestAsyncProfileStore struct {
 	Samples chan Sample
+
+	mu  sync.Mutex
+	all []Sample // every sample ever stored, regardless of whether it was read off Samples.
 }
 
 func NewTestAsyncProfileStore() *TestAsyncProfileStore {
@@ -120,14 +146,20 @@ func (tpw *TestAsyncProfileStore) Store(ctx context.Context, labels model.LabelS
 	if !ok {
 		return errors.New("profile is not a pprof profile")
 	}
+	sample := Sample{
+		Labels:  labels,
+		Profile: p,
+	}
+
+	tpw.mu.Lock()
+	tpw.all = append(tpw.all, sample)
+	tpw.mu.Unlock()
+
 	select {
 	case <-ctx.Done():
 		return nil
 	default:
-		tpw.Samples <- Sample{
-			Labels:  labels,
-			Profile: p,
-		}
+		tpw.Samples <- sample
 	}
 	return nil
 }
@@ -136,11 +168,27 @@ func (tpw *TestAsyncProfileStore) Close() {
 	close(tpw.Samples)
 }
 
+// All returns every sample stored so far, including ones that were never
+// read off Samples (e.g. because the test stopped consuming before the
+// profiler shut down). Safe to call concurrently with Store.
+func (tpw *TestAsyncProfileStore) All() []Sample {
+	tpw.mu.Lock()
+	defer tpw.mu.Unlock()
+	out := make([]Sample, len(tpw.all))
+	copy(out, tpw.all)
+	return out
+}
+
 // IsRunningOnCI returns whether we might be running in a continuous integration environment. GitHub
-// Actions and most other CI platforms set the CI environment variable.
+// Actions and most other CI platforms set the CI environment variable; Buildkite additionally sets
+// BUILDKITE_AGENT_NAME, which we check in case CI itself isn't set by a given agent configuration.
 func IsRunningOnCI() bool {
-	_, ok := os.LookupEnv("CI")
-	return ok
+	for _, env := range []string{"CI", "GITHUB_ACTIONS", "BUILDKITE_AGENT_NAME"} {
+		if _, ok := os.LookupEnv(env); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // ProfileDuration sets the profile runtime to a shorter time period
@@ -384,4 +432,105 @@ func RunAndAwaitSamples(t *testing.T, ctx context.Context, profiler *cpu.CPU, pr
 	if !passed {
 		t.Fail()
 	}
+	if !passed || keepArtifacts {
+		writeSampleArtifacts(t, profileStore.All())
+	}
+}
+
+// artifactsDir returns the directory failing-test artifacts are written
+// under, defaulting to "artifacts" in the working directory when
+// $ARTIFACTS_DIR isn't set.
+func artifactsDir() string {
+	if d := os.Getenv("ARTIFACTS_DIR"); d != "" {
+		return d
+	}
+	return "artifacts"
+}
+
+// sampleManifestEntry describes one captured sample in manifest.json.
+type sampleManifestEntry struct {
+	File      string         `json:"file"`
+	Labels    model.LabelSet `json:"labels"`
+	Samples   int            `json:"samples"`
+	Locations int            `json:"locations"`
+	Mappings  int            `json:"mappings"`
+}
+
+// writeSampleArtifacts writes every sample in samples to
+// $ARTIFACTS_DIR/<testname>/<label-hash>-<index>.pb.gz, plus a manifest.json
+// summarizing them, so a flaky failure can be debugged offline without
+// re-running the test under LogTracingPipe.
+func writeSampleArtifacts(t *testing.T, samples []Sample) {
+	t.Helper()
+	if len(samples) == 0 {
+		return
+	}
+
+	dir := filepath.Join(artifactsDir(), sanitizeArtifactName(t.Name()))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Logf("failed to create artifacts dir %s: %s", dir, err)
+		return
+	}
+
+	manifest := make([]sampleManifestEntry, 0, len(samples))
+	for i, sample := range samples {
+		name := fmt.Sprintf("%s-%d.pb.gz", labelHash(sample.Labels), i)
+		path := filepath.Join(dir, name)
+
+		f, err := os.Create(path)
+		if err != nil {
+			t.Logf("failed to create artifact %s: %s", path, err)
+			continue
+		}
+		err = sample.Profile.Write(f)
+		f.Close()
+		if err != nil {
+			t.Logf("failed to write artifact %s: %s", path, err)
+			continue
+		}
+
+		manifest = append(manifest, sampleManifestEntry{
+			File:      name,
+			Labels:    sample.Labels,
+			Samples:   len(sample.Profile.Sample),
+			Locations: len(sample.Profile.Location),
+			Mappings:  len(sample.Profile.Mapping),
+		})
+
+		if IsRunningOnCI() {
+			// A line CI post-command hooks can grep for to pick up and
+			// upload the artifact without re-running the test.
+			fmt.Printf("##artifact %s\n", path)
+		}
+	}
+
+	manifestPath := filepath.Join(dir, "manifest.json")
+	manifestFile, err := os.Create(manifestPath)
+	if err != nil {
+		t.Logf("failed to create manifest %s: %s", manifestPath, err)
+		return
+	}
+	defer manifestFile.Close()
+
+	enc := json.NewEncoder(manifestFile)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		t.Logf("failed to write manifest %s: %s", manifestPath, err)
+		return
+	}
+
+	t.Logf("wrote %d sample artifacts to %s", len(manifest), dir)
+}
+
+// labelHash returns a short, stable identifier for a sample's label set so
+// artifact filenames stay both deterministic and collision-resistant
+// between runs of the same test.
+func labelHash(labels model.LabelSet) string {
+	h := fnv.New64a()
+	fmt.Fprint(h, labels.String())
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func sanitizeArtifactName(name string) string {
+	return strings.NewReplacer("/", "_", " ", "_").Replace(name)
 }
@@ -0,0 +1,532 @@
+// Copyright 2022-2024 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package perftest drives the CPU profiler against configurable synthetic
+// workloads for a fixed duration, sampling the agent's own resource usage
+// along the way, so that regressions in unwinder overhead can be caught
+// before release instead of being noticed in production.
+package perftest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	goruntime "runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/procfs"
+
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/profiler/cpu"
+	"github.com/parca-dev/parca-agent/test/integration"
+)
+
+// WorkloadKind selects which kind of synthetic load a Workload generates.
+type WorkloadKind string
+
+const (
+	// WorkloadCPU spins a configurable number of goroutines doing
+	// CPU-bound work for the lifetime of the test.
+	WorkloadCPU WorkloadKind = "cpu"
+	// WorkloadForkExec repeatedly forks and execs a short-lived process at
+	// a configurable rate, to stress PID churn in the process-info and
+	// unwind-info caches.
+	WorkloadForkExec WorkloadKind = "forkexec"
+	// WorkloadGuestProcess runs one of the interpreter/JIT fixtures used by
+	// the rest of the integration suite (Python, Ruby, JVM) under load.
+	WorkloadGuestProcess WorkloadKind = "guest"
+)
+
+// Workload describes one synthetic load generator to run alongside the
+// profiler under test.
+type Workload struct {
+	Kind WorkloadKind
+
+	// WorkloadCPU.
+	Goroutines int
+
+	// WorkloadForkExec.
+	ForkRate     float64 // processes per second.
+	ForkLifetime time.Duration
+
+	// WorkloadGuestProcess.
+	GuestBinary string
+	GuestArgs   []string
+	Count       int
+}
+
+// start launches the workload and returns a func that stops it. The
+// workload also stops on its own once ctx is cancelled.
+func (w Workload) start(ctx context.Context, logger log.Logger) (stop func(), err error) {
+	var wg sync.WaitGroup
+
+	switch w.Kind {
+	case WorkloadCPU:
+		n := w.Goroutines
+		if n <= 0 {
+			n = goruntime.GOMAXPROCS(0)
+		}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				busyLoop(ctx)
+			}()
+		}
+	case WorkloadForkExec:
+		rate := w.ForkRate
+		if rate <= 0 {
+			rate = 1
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forkExecLoop(ctx, logger, time.Duration(float64(time.Second)/rate), w.ForkLifetime)
+		}()
+	case WorkloadGuestProcess:
+		if w.GuestBinary == "" {
+			return nil, fmt.Errorf("perftest: guest process workload requires GuestBinary")
+		}
+		n := w.Count
+		if n <= 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				guestProcessLoop(ctx, logger, w.GuestBinary, w.GuestArgs)
+			}()
+		}
+	default:
+		return nil, fmt.Errorf("perftest: unknown workload kind %q", w.Kind)
+	}
+
+	return wg.Wait, nil
+}
+
+func busyLoop(ctx context.Context) {
+	var x uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			x += x*31 + 1
+		}
+	}
+}
+
+func forkExecLoop(ctx context.Context, logger log.Logger, period, lifetime time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			runCtx := ctx
+			var cancel context.CancelFunc
+			if lifetime > 0 {
+				runCtx, cancel = context.WithTimeout(ctx, lifetime)
+			}
+			cmd := exec.CommandContext(runCtx, "sleep", "0.05") //nolint:gosec
+			if err := cmd.Run(); err != nil && ctx.Err() == nil {
+				level.Debug(logger).Log("msg", "perftest forkexec workload exited", "err", err)
+			}
+			if cancel != nil {
+				cancel()
+			}
+		}
+	}
+}
+
+func guestProcessLoop(ctx context.Context, logger log.Logger, binary string, args []string) {
+	for ctx.Err() == nil {
+		cmd := exec.CommandContext(ctx, binary, args...) //nolint:gosec
+		if err := cmd.Run(); err != nil && ctx.Err() == nil {
+			level.Debug(logger).Log("msg", "perftest guest process exited", "binary", binary, "err", err)
+		}
+	}
+}
+
+// Config configures a single perftest run.
+type Config struct {
+	Duration       time.Duration
+	Workloads      []Workload
+	SampleInterval time.Duration
+
+	// PprofDir, when non-empty, receives cpu.pprof, heap.pprof,
+	// block.pprof, mutex.pprof and trace.out captured for the perftest
+	// process itself, so unwinder overhead can be attributed.
+	PprofDir string
+}
+
+// Sample is one point-in-time measurement of resource usage taken during a
+// Run.
+type Sample struct {
+	ElapsedSeconds float64
+	RSSBytes       uint64 // process-wide resident set size, read from /proc/self/stat.
+	HeapAllocBytes uint64 // Go heap bytes in use; useful alongside RSSBytes to separate Go-heap growth from e.g. BPF map or mmap growth.
+	NumGoroutine   int
+	BPFMapBytes    uint64
+}
+
+// Report is the outcome of a Run, suitable for comparing across builds.
+type Report struct {
+	Config           Config
+	Samples          []Sample
+	SamplesTotal     uint64
+	DroppedSamples   uint64
+	SamplesPerSec    float64
+	MaxRSSBytes      uint64 // max of Samples[i].RSSBytes, i.e. actual process RSS, not Go heap alloc.
+	WallClockSeconds float64
+}
+
+// Run builds a CPU profiler via integration.NewTestProfiler, drives it
+// against the configured workloads for cfg.Duration, and samples resource
+// usage every cfg.SampleInterval, returning a Report.
+func Run(ctx context.Context, logger log.Logger, reg *prometheus.Registry, ofp *objectfile.Pool, tempDir string, cpuCfg *cpu.Config, cfg Config) (*Report, error) {
+	if cfg.SampleInterval <= 0 {
+		cfg.SampleInterval = time.Second
+	}
+
+	stopProfiles, err := startSelfProfiles(cfg.PprofDir)
+	if err != nil {
+		return nil, fmt.Errorf("perftest: starting self-profiles: %w", err)
+	}
+	defer stopProfiles()
+
+	store := integration.NewTestAsyncProfileStore()
+	defer store.Close()
+
+	profiler, err := integration.NewTestProfiler(logger, reg, ofp, store, tempDir, cpuCfg)
+	if err != nil {
+		return nil, fmt.Errorf("perftest: building profiler: %w", err)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	profilerDone := make(chan error, 1)
+	go func() { profilerDone <- profiler.Run(runCtx) }()
+
+	var stops []func()
+	for _, w := range cfg.Workloads {
+		stop, err := w.start(runCtx, logger)
+		if err != nil {
+			cancel()
+			for _, s := range stops {
+				s()
+			}
+			return nil, fmt.Errorf("perftest: starting workload %s: %w", w.Kind, err)
+		}
+		stops = append(stops, stop)
+	}
+
+	var samplesSeen uint64
+	go func() {
+		for range store.Samples {
+			atomic.AddUint64(&samplesSeen, 1)
+		}
+	}()
+
+	report := &Report{Config: cfg}
+	start := time.Now()
+
+	t := time.NewTicker(cfg.SampleInterval)
+	defer t.Stop()
+loop:
+	for {
+		select {
+		case <-runCtx.Done():
+			break loop
+		case <-t.C:
+			report.Samples = append(report.Samples, sampleNow(logger, start, reg))
+		}
+	}
+
+	for _, stop := range stops {
+		stop()
+	}
+	cancel()
+	if err := <-profilerDone; err != nil && ctx.Err() == nil {
+		level.Warn(logger).Log("msg", "profiler exited with error during perftest run", "err", err)
+	}
+
+	report.WallClockSeconds = time.Since(start).Seconds()
+	report.SamplesTotal = atomic.LoadUint64(&samplesSeen)
+	if report.WallClockSeconds > 0 {
+		report.SamplesPerSec = float64(report.SamplesTotal) / report.WallClockSeconds
+	}
+
+	droppedSamples, found := gaugeValue(reg, "parca_agent_profiler_samples_dropped_total")
+	warnIfMetricMissing(logger, "parca_agent_profiler_samples_dropped_total", found)
+	report.DroppedSamples = droppedSamples
+
+	for _, s := range report.Samples {
+		if s.RSSBytes > report.MaxRSSBytes {
+			report.MaxRSSBytes = s.RSSBytes
+		}
+	}
+
+	return report, nil
+}
+
+func sampleNow(logger log.Logger, start time.Time, reg *prometheus.Registry) Sample {
+	var m goruntime.MemStats
+	goruntime.ReadMemStats(&m)
+
+	rss, err := residentMemoryBytes()
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to read process RSS, sample will report 0", "err", err)
+	}
+
+	bpfMapBytes, found := gaugeValue(reg, "parca_agent_bpf_map_memory_bytes")
+	warnIfMetricMissing(logger, "parca_agent_bpf_map_memory_bytes", found)
+
+	return Sample{
+		ElapsedSeconds: time.Since(start).Seconds(),
+		RSSBytes:       rss,
+		HeapAllocBytes: m.HeapAlloc,
+		NumGoroutine:   goruntime.NumGoroutine(),
+		BPFMapBytes:    bpfMapBytes,
+	}
+}
+
+// residentMemoryBytes reads the perftest process's own resident set size.
+// Unlike runtime.MemStats.HeapAlloc, this also reflects non-Go-heap growth
+// such as BPF map memory or mmap'd regions, which is what -compare is meant
+// to catch regressions in.
+func residentMemoryBytes() (uint64, error) {
+	p, err := procfs.Self()
+	if err != nil {
+		return 0, err
+	}
+	stat, err := p.Stat()
+	if err != nil {
+		return 0, err
+	}
+	rss := stat.ResidentMemory()
+	if rss < 0 {
+		return 0, nil
+	}
+	return uint64(rss), nil
+}
+
+// gaugeValue sums every series of the named gauge/counter metric family
+// found in reg. found is false if no such family is registered at all, as
+// opposed to being registered with a value of zero; callers should treat
+// that case differently (see warnIfMetricMissing) since silently reading it
+// as zero would defeat -compare's ability to catch a regression in it.
+func gaugeValue(reg *prometheus.Registry, name string) (value uint64, found bool) {
+	families, err := reg.Gather()
+	if err != nil {
+		return 0, false
+	}
+	var total float64
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		found = true
+		for _, m := range f.GetMetric() {
+			total += metricValue(m)
+		}
+	}
+	if total < 0 {
+		total = 0
+	}
+	return uint64(total), found
+}
+
+// metricWarned tracks which metric names warnIfMetricMissing has already
+// logged about, so a perftest run sampling once a second doesn't spam the
+// same warning for its whole duration.
+var metricWarned sync.Map // metric name -> struct{}.
+
+func warnIfMetricMissing(logger log.Logger, name string, found bool) {
+	if found {
+		return
+	}
+	if _, already := metricWarned.LoadOrStore(name, struct{}{}); already {
+		return
+	}
+	level.Warn(logger).Log(
+		"msg", "metric not found in registry; any -compare regression check against it will be meaningless",
+		"metric", name)
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.GetGauge() != nil:
+		return m.GetGauge().GetValue()
+	case m.GetCounter() != nil:
+		return m.GetCounter().GetValue()
+	default:
+		return 0
+	}
+}
+
+func startSelfProfiles(dir string) (stop func(), err error) {
+	if dir == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	cpuFile, err := os.Create(dir + "/cpu.pprof")
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(cpuFile); err != nil {
+		cpuFile.Close()
+		return nil, err
+	}
+
+	traceFile, err := os.Create(dir + "/trace.out")
+	if err != nil {
+		pprof.StopCPUProfile()
+		cpuFile.Close()
+		return nil, err
+	}
+	if err := trace.Start(traceFile); err != nil {
+		pprof.StopCPUProfile()
+		cpuFile.Close()
+		traceFile.Close()
+		return nil, err
+	}
+
+	return func() {
+		trace.Stop()
+		traceFile.Close()
+		pprof.StopCPUProfile()
+		cpuFile.Close()
+
+		for _, p := range []string{"heap", "block", "mutex"} {
+			f, err := os.Create(fmt.Sprintf("%s/%s.pprof", dir, p))
+			if err != nil {
+				continue
+			}
+			_ = pprof.Lookup(p).WriteTo(f, 0)
+			f.Close()
+		}
+	}, nil
+}
+
+// WriteJSON writes r to path as JSON.
+func WriteJSON(path string, r *Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteMarkdown writes a short human-readable summary of r to path.
+func WriteMarkdown(path string, r *Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "# perftest report\n\n"+
+		"| metric | value |\n|---|---|\n"+
+		"| duration | %.1fs |\n"+
+		"| samples/sec | %.2f |\n"+
+		"| dropped samples | %d |\n"+
+		"| max RSS | %d bytes |\n",
+		r.WallClockSeconds, r.SamplesPerSec, r.DroppedSamples, r.MaxRSSBytes)
+	return err
+}
+
+// ReadJSON reads back a Report previously written by WriteJSON.
+func ReadJSON(path string) (*Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r Report
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Thresholds bounds how much a candidate Report may regress against a
+// baseline before Compare reports it as a failure.
+type Thresholds struct {
+	MaxThroughputRegressionPct float64
+	MaxRSSRegressionPct        float64
+	MaxDroppedSamplesIncrease  uint64
+}
+
+// DefaultThresholds are conservative enough to catch real regressions
+// without flaking on normal run-to-run noise.
+var DefaultThresholds = Thresholds{
+	MaxThroughputRegressionPct: 10,
+	MaxRSSRegressionPct:        15,
+	MaxDroppedSamplesIncrease:  0,
+}
+
+// Compare diffs candidate against baseline and returns one message per
+// metric that regressed beyond t. A non-empty result means the comparison
+// should be treated as a failure.
+func Compare(baseline, candidate *Report, t Thresholds) []string {
+	var regressions []string
+
+	if pctDrop(baseline.SamplesPerSec, candidate.SamplesPerSec) > t.MaxThroughputRegressionPct {
+		regressions = append(regressions, fmt.Sprintf(
+			"samples/sec regressed: %.2f -> %.2f", baseline.SamplesPerSec, candidate.SamplesPerSec))
+	}
+	if pctIncrease(float64(baseline.MaxRSSBytes), float64(candidate.MaxRSSBytes)) > t.MaxRSSRegressionPct {
+		regressions = append(regressions, fmt.Sprintf(
+			"max RSS regressed: %d -> %d bytes", baseline.MaxRSSBytes, candidate.MaxRSSBytes))
+	}
+	if candidate.DroppedSamples > baseline.DroppedSamples+t.MaxDroppedSamplesIncrease {
+		regressions = append(regressions, fmt.Sprintf(
+			"dropped samples regressed: %d -> %d", baseline.DroppedSamples, candidate.DroppedSamples))
+	}
+
+	return regressions
+}
+
+func pctDrop(baseline, candidate float64) float64 {
+	if baseline <= 0 {
+		return 0
+	}
+	return (baseline - candidate) / baseline * 100
+}
+
+func pctIncrease(baseline, candidate float64) float64 {
+	if baseline <= 0 {
+		return 0
+	}
+	return (candidate - baseline) / baseline * 100
+}
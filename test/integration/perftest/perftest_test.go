@@ -0,0 +1,99 @@
+// Copyright 2022-2024 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package perftest
+
+import "testing"
+
+func TestPctDrop(t *testing.T) {
+	cases := []struct {
+		name                string
+		baseline, candidate float64
+		want                float64
+	}{
+		{"no change", 100, 100, 0},
+		{"improvement", 100, 150, -50},
+		{"regression", 100, 90, 10},
+		{"zero baseline", 0, 50, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pctDrop(tc.baseline, tc.candidate); got != tc.want {
+				t.Errorf("pctDrop(%v, %v) = %v, want %v", tc.baseline, tc.candidate, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPctIncrease(t *testing.T) {
+	cases := []struct {
+		name                string
+		baseline, candidate float64
+		want                float64
+	}{
+		{"no change", 100, 100, 0},
+		{"increase", 100, 120, 20},
+		{"decrease", 100, 80, -20},
+		{"zero baseline", 0, 50, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pctIncrease(tc.baseline, tc.candidate); got != tc.want {
+				t.Errorf("pctIncrease(%v, %v) = %v, want %v", tc.baseline, tc.candidate, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := &Report{SamplesPerSec: 1000, MaxRSSBytes: 100_000_000, DroppedSamples: 0}
+
+	t.Run("no regressions", func(t *testing.T) {
+		candidate := &Report{SamplesPerSec: 1000, MaxRSSBytes: 100_000_000, DroppedSamples: 0}
+		if got := Compare(baseline, candidate, DefaultThresholds); len(got) != 0 {
+			t.Errorf("expected no regressions, got %v", got)
+		}
+	})
+
+	t.Run("throughput regression", func(t *testing.T) {
+		candidate := &Report{SamplesPerSec: 800, MaxRSSBytes: 100_000_000, DroppedSamples: 0}
+		got := Compare(baseline, candidate, DefaultThresholds)
+		if len(got) != 1 {
+			t.Fatalf("expected exactly one regression, got %v", got)
+		}
+	})
+
+	t.Run("rss regression", func(t *testing.T) {
+		candidate := &Report{SamplesPerSec: 1000, MaxRSSBytes: 150_000_000, DroppedSamples: 0}
+		got := Compare(baseline, candidate, DefaultThresholds)
+		if len(got) != 1 {
+			t.Fatalf("expected exactly one regression, got %v", got)
+		}
+	})
+
+	t.Run("dropped samples regression", func(t *testing.T) {
+		candidate := &Report{SamplesPerSec: 1000, MaxRSSBytes: 100_000_000, DroppedSamples: 5}
+		got := Compare(baseline, candidate, DefaultThresholds)
+		if len(got) != 1 {
+			t.Fatalf("expected exactly one regression, got %v", got)
+		}
+	})
+
+	t.Run("within thresholds", func(t *testing.T) {
+		candidate := &Report{SamplesPerSec: 950, MaxRSSBytes: 105_000_000, DroppedSamples: 0}
+		if got := Compare(baseline, candidate, DefaultThresholds); len(got) != 0 {
+			t.Errorf("expected no regressions within threshold, got %v", got)
+		}
+	})
+}